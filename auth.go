@@ -0,0 +1,88 @@
+package gobits
+
+import (
+	"net/http"
+)
+
+// Principal identifies the authenticated caller of a BITS request.
+type Principal struct {
+	// Name is the authenticated identity, e.g. a Basic auth username,
+	// a bearer token's subject, or a client certificate's CN.
+	Name string
+}
+
+// Authenticator authenticates an incoming BITS request before packet
+// dispatch. It returns the authenticated Principal, or ok == false if
+// the request should be rejected with 401 Unauthorized.
+type Authenticator interface {
+	Authenticate(r *http.Request) (p *Principal, ok bool, err error)
+}
+
+// FilenameAuthorizer can optionally be implemented by an Authenticator
+// to override the global cfg.Allowed/cfg.Disallowed regex sets with
+// per-user allow/deny lists. A nil return for either list means "fall
+// back to the global list".
+type FilenameAuthorizer interface {
+	AuthorizeFilename(p *Principal, filename string) (allowed, disallowed []string)
+}
+
+// authenticate runs b.auth, if configured, against r. It always
+// succeeds with a nil Principal when no Authenticator is configured.
+func (b *Handler) authenticate(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	if b.auth == nil {
+		return nil, true
+	}
+	p, ok, err := b.auth.Authenticate(r)
+	if err != nil {
+		b.logger.Error("error authenticating request", "error", err)
+		http.Error(w, "Internal Server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="BITS"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	return p, true
+}
+
+// authorizeSession checks that principal is allowed to act on an
+// existing session: either no Authenticator is configured, the session
+// has no recorded owner, or principal created it.
+func (b *Handler) authorizeSession(w http.ResponseWriter, uuid string, principal *Principal, sess *Session) bool {
+	if b.auth == nil || sess.Principal == "" {
+		return true
+	}
+	if principal != nil && principal.Name == sess.Principal {
+		return true
+	}
+	b.logger.Warn("principal is not the owner of session", "principal", principalName(principal), "session", uuid)
+	bitsError(w, uuid, http.StatusForbidden, 0, ErrorContextRemoteFile)
+	return false
+}
+
+func principalName(p *Principal) string {
+	if p == nil {
+		return ""
+	}
+	return p.Name
+}
+
+// allowedAndDisallowed returns the Allowed/Disallowed regex lists to
+// check filename against, preferring an Authenticator's per-user
+// FilenameAuthorizer override over the global cfg lists.
+func (b *Handler) allowedAndDisallowed(principal *Principal, filename string) (allowed, disallowed []string) {
+	allowed, disallowed = b.cfg.Allowed, b.cfg.Disallowed
+	fa, ok := b.auth.(FilenameAuthorizer)
+	if !ok {
+		return allowed, disallowed
+	}
+	userAllowed, userDisallowed := fa.AuthorizeFilename(principal, filename)
+	if userAllowed != nil {
+		allowed = userAllowed
+	}
+	if userDisallowed != nil {
+		disallowed = userDisallowed
+	}
+	return allowed, disallowed
+}
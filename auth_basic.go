@@ -0,0 +1,86 @@
+package gobits
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BasicAuthenticator authenticates requests against an htpasswd-style
+// file of "user:bcryptHash" lines. The file can be reloaded at runtime
+// (e.g. from a SIGHUP handler) via Reload; reads are protected by an
+// RWMutex, and Reload parses the file before taking the write lock, so
+// concurrent authentication is blocked only while the table is swapped.
+type BasicAuthenticator struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string][]byte
+}
+
+// NewBasicAuthenticator loads path and returns a BasicAuthenticator
+// backed by it.
+func NewBasicAuthenticator(path string) (*BasicAuthenticator, error) {
+	a := &BasicAuthenticator{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload re-reads the htpasswd file from disk, replacing the in-memory
+// user table atomically once parsing succeeds.
+func (a *BasicAuthenticator) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("gobits: malformed htpasswd line %q", line)
+		}
+		users[parts[0]] = []byte(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.users = users
+	a.mu.Unlock()
+	return nil
+}
+
+// Authenticate implements Authenticator.
+func (a *BasicAuthenticator) Authenticate(r *http.Request) (*Principal, bool, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, false, nil
+	}
+
+	a.mu.RLock()
+	hash, ok := a.users[user]
+	a.mu.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(pass)); err != nil {
+		return nil, false, nil
+	}
+	return &Principal{Name: user}, true, nil
+}
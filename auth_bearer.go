@@ -0,0 +1,57 @@
+package gobits
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// BearerAuthenticator authenticates requests carrying an
+// "Authorization: Bearer <token>" header against a static token table
+// mapping each token to the Principal it authenticates as.
+type BearerAuthenticator struct {
+	mu     sync.RWMutex
+	tokens map[string]*Principal
+}
+
+// NewBearerAuthenticator returns a BearerAuthenticator where each key
+// of tokens authenticates as the Principal named by its value.
+func NewBearerAuthenticator(tokens map[string]string) *BearerAuthenticator {
+	a := &BearerAuthenticator{tokens: make(map[string]*Principal, len(tokens))}
+	for token, name := range tokens {
+		a.tokens[token] = &Principal{Name: name}
+	}
+	return a
+}
+
+// SetToken adds or replaces the principal a token authenticates as.
+func (a *BearerAuthenticator) SetToken(token, principalName string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tokens[token] = &Principal{Name: principalName}
+}
+
+// RevokeToken removes a token from the table.
+func (a *BearerAuthenticator) RevokeToken(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.tokens, token)
+}
+
+// Authenticate implements Authenticator.
+func (a *BearerAuthenticator) Authenticate(r *http.Request) (*Principal, bool, error) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return nil, false, nil
+	}
+	token := strings.TrimPrefix(header, prefix)
+
+	a.mu.RLock()
+	p, ok := a.tokens[token]
+	a.mu.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+	return p, true, nil
+}
@@ -0,0 +1,36 @@
+package gobits
+
+import "net/http"
+
+// ClientCertAuthenticator authenticates requests by the Subject Common
+// Name of the client certificate presented during the TLS handshake.
+// It's meant for servers configured with tls.Config.ClientAuth set to
+// require and verify a client certificate; this Authenticator only
+// decides which of those verified certificates are recognized.
+type ClientCertAuthenticator struct {
+	// AllowedCNs is the set of Subject Common Names accepted as valid
+	// principals.
+	AllowedCNs map[string]bool
+}
+
+// NewClientCertAuthenticator returns a ClientCertAuthenticator
+// accepting any of the given Common Names.
+func NewClientCertAuthenticator(commonNames ...string) *ClientCertAuthenticator {
+	a := &ClientCertAuthenticator{AllowedCNs: make(map[string]bool, len(commonNames))}
+	for _, cn := range commonNames {
+		a.AllowedCNs[cn] = true
+	}
+	return a
+}
+
+// Authenticate implements Authenticator.
+func (a *ClientCertAuthenticator) Authenticate(r *http.Request) (*Principal, bool, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, false, nil
+	}
+	cn := r.TLS.PeerCertificates[0].Subject.CommonName
+	if !a.AllowedCNs[cn] {
+		return nil, false, nil
+	}
+	return &Principal{Name: cn}, true, nil
+}
@@ -0,0 +1,73 @@
+package gobits
+
+import (
+	"errors"
+	"sync"
+)
+
+// errTooManyInflight is returned when a session already has its
+// configured maximum number of Fragment requests queued or in flight.
+var errTooManyInflight = errors.New("gobits: too many fragment requests in flight for session")
+
+// sessionGate serializes Fragment requests for a single BITS session
+// behind a per-session mutex, so concurrent/retried fragments for the
+// same session can't race on file offsets, while different sessions
+// stay fully parallel. It also bounds how many requests may be queued
+// for a given session's mutex at once, so a client that pipelines or
+// retries aggressively can't pile up unbounded goroutines.
+type sessionGate struct {
+	maxInflight int
+
+	mu      sync.Mutex
+	entries map[string]*sessionGateEntry
+}
+
+type sessionGateEntry struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// newSessionGate returns a sessionGate allowing at most maxInflight
+// concurrent/queued Fragment requests per session. maxInflight <= 0
+// means unlimited.
+func newSessionGate(maxInflight int) *sessionGate {
+	return &sessionGate{
+		maxInflight: maxInflight,
+		entries:     make(map[string]*sessionGateEntry),
+	}
+}
+
+// lock blocks until it holds the mutex for sessionID, returning a token
+// to pass to unlock. It returns errTooManyInflight instead of blocking
+// if sessionID already has maxInflight requests queued or holding the
+// lock.
+func (g *sessionGate) lock(sessionID string) (*sessionGateEntry, error) {
+	g.mu.Lock()
+	e, ok := g.entries[sessionID]
+	if !ok {
+		e = &sessionGateEntry{}
+		g.entries[sessionID] = e
+	}
+	if g.maxInflight > 0 && e.refs >= g.maxInflight {
+		g.mu.Unlock()
+		return nil, errTooManyInflight
+	}
+	e.refs++
+	g.mu.Unlock()
+
+	e.mu.Lock()
+	return e, nil
+}
+
+// unlock releases the mutex acquired by lock, removing sessionID's
+// entry once nothing references it anymore.
+func (g *sessionGate) unlock(sessionID string, e *sessionGateEntry) {
+	e.mu.Unlock()
+
+	g.mu.Lock()
+	e.refs--
+	if e.refs == 0 {
+		delete(g.entries, sessionID)
+	}
+	g.mu.Unlock()
+}
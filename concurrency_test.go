@@ -0,0 +1,91 @@
+package gobits
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionGateSerializesSameSession(t *testing.T) {
+	g := newSessionGate(0)
+
+	var mu sync.Mutex
+	var order []int
+	var active int
+	var wg sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e, err := g.lock("sess-a")
+			if err != nil {
+				t.Errorf("lock() error = %v", err)
+				return
+			}
+			defer g.unlock("sess-a", e)
+
+			mu.Lock()
+			active++
+			if active > 1 {
+				t.Errorf("%d goroutines hold the sess-a lock at once, want 1", active)
+			}
+			order = append(order, i)
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(order) != 5 {
+		t.Fatalf("got %d completions, want 5", len(order))
+	}
+	if len(g.entries) != 0 {
+		t.Errorf("sessionGate leaked %d entries after all unlocks", len(g.entries))
+	}
+}
+
+func TestSessionGateDifferentSessionsRunConcurrently(t *testing.T) {
+	g := newSessionGate(0)
+
+	eA, err := g.lock("sess-a")
+	if err != nil {
+		t.Fatalf("lock(sess-a) error = %v", err)
+	}
+	defer g.unlock("sess-a", eA)
+
+	done := make(chan struct{})
+	go func() {
+		eB, err := g.lock("sess-b")
+		if err != nil {
+			t.Errorf("lock(sess-b) error = %v", err)
+			return
+		}
+		g.unlock("sess-b", eB)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lock(sess-b) blocked on an unrelated session's lock")
+	}
+}
+
+func TestSessionGateMaxInflight(t *testing.T) {
+	g := newSessionGate(1)
+
+	e, err := g.lock("sess-a")
+	if err != nil {
+		t.Fatalf("lock() error = %v", err)
+	}
+	defer g.unlock("sess-a", e)
+
+	if _, err := g.lock("sess-a"); err != errTooManyInflight {
+		t.Fatalf("lock() error = %v, want errTooManyInflight", err)
+	}
+}
@@ -0,0 +1,36 @@
+package gobits
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// errSessionNotFound is returned by SessionStore implementations when
+// an operation is attempted against a session id that isn't known.
+var errSessionNotFound = errors.New("gobits: session not found")
+
+// ErrorContext identifies which part of the BITS pipeline an error
+// originated in, as carried in the BITS-Error-Context response header.
+// https://msdn.microsoft.com/en-us/library/aa362797(v=vs.85).aspx
+type ErrorContext uint32
+
+const (
+	// ErrorContextNone is used when no more specific context applies.
+	ErrorContextNone ErrorContext = 0x1
+	// ErrorContextRemoteFile indicates the error relates to the file
+	// being uploaded.
+	ErrorContextRemoteFile ErrorContext = 0x5
+)
+
+// bitsError writes a BITS-flavored error response: it sets the
+// BITS-Error-Context and, if sessionID is non-empty, BITS-Session-Id
+// headers before responding with httpStatus.
+func bitsError(w http.ResponseWriter, sessionID string, httpStatus int, errorCode uint32, context ErrorContext) {
+	if sessionID != "" {
+		w.Header().Add("BITS-Session-Id", sessionID)
+	}
+	w.Header().Add("BITS-Error-Context", strconv.FormatUint(uint64(context), 10))
+	w.Header().Add("BITS-Error-Code", strconv.FormatUint(uint64(errorCode), 10))
+	http.Error(w, http.StatusText(httpStatus), httpStatus)
+}
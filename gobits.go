@@ -0,0 +1,223 @@
+// Package gobits implements an http.Handler that speaks the server side
+// of the Microsoft BITS (Background Intelligent Transfer Service)
+// upload protocol, so that BITS clients (including bitsadmin.exe and the
+// Windows BITS service) can upload files to a Go server.
+package gobits
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// Event identifies the kind of lifecycle event a CallbackFunc is invoked
+// for.
+type Event int
+
+const (
+	// EventCreateSession fires once a new BITS session has been created
+	// and its Storage backend has allocated space for it.
+	EventCreateSession Event = iota
+	// EventRecieveFile fires once a file has been fully received for a
+	// session.
+	EventRecieveFile
+	// EventCancelSession fires when a client cancels a session.
+	EventCancelSession
+	// EventCloseSession fires when a client closes a session after a
+	// successful upload.
+	EventCloseSession
+)
+
+// CallbackFunc is invoked by the Handler whenever one of the Event
+// values above occurs. path is the session's temporary directory for
+// EventCreateSession/EventCancelSession/EventCloseSession, or the path
+// to the received file for EventRecieveFile.
+type CallbackFunc func(event Event, sessionID string, path string)
+
+// PrincipalCallbackFunc is a CallbackFunc variant that also receives
+// the Principal authenticated for the request that triggered event.
+// principal is nil when no Authenticator is configured. Install one
+// with Handler.SetPrincipalCallback; it takes priority over a plain
+// CallbackFunc set via NewHandler.
+type PrincipalCallbackFunc func(event Event, sessionID string, path string, principal *Principal)
+
+// FileResult describes a fully received file, including the content
+// digests configured via Config.ComputeMD5/Config.ComputeSHA256. MD5
+// and SHA256 are lowercase hex, or empty if not computed (or if a
+// resumed upload lost its hash state partway through).
+type FileResult struct {
+	Path   string
+	Size   uint64
+	MD5    string
+	SHA256 string
+}
+
+// FileCallbackFunc is the most specific lifecycle callback: it fires
+// only for EventRecieveFile, carrying the finalized FileResult instead
+// of just a path. It takes priority over PrincipalCallbackFunc and
+// CallbackFunc when set via SetFileCallback. Its return value, if
+// non-empty, is the application-defined reply body delivered to the
+// client on Close-Session per the BITS upload-reply protocol; it is
+// ignored for sessions that didn't negotiate Config.ReplyProtocol.
+type FileCallbackFunc func(sessionID string, result FileResult, principal *Principal) (reply []byte)
+
+// Config holds the settings that control how a Handler accepts and
+// stores BITS uploads.
+type Config struct {
+	// AllowedMethod is the HTTP method BITS requests must use (BITS
+	// clients use "BITS_POST").
+	AllowedMethod string
+	// Protocol is the BITS-Supported-Protocols GUID this server
+	// accepts.
+	Protocol string
+	// TempDir is the directory sessions are stored under, one
+	// subdirectory per session UUID.
+	TempDir string
+	// Allowed is a list of regular expressions; an uploaded filename
+	// must match at least one of them.
+	Allowed []string
+	// Disallowed is a list of regular expressions; an uploaded filename
+	// matching any of them is rejected.
+	Disallowed []string
+	// MaxSize, if non-zero, is the maximum accepted total file length
+	// in bytes.
+	MaxSize uint64
+	// MaxInflightPerSession, if non-zero, is how many Fragment requests
+	// may be queued or in flight for a single session at once; further
+	// requests are rejected with 503 rather than queuing unbounded.
+	MaxInflightPerSession int
+	// MaxConcurrentFragments, if non-zero, bounds how many Fragment
+	// requests may be writing at once across all sessions.
+	MaxConcurrentFragments int
+	// ComputeMD5 and ComputeSHA256 select which content digests are
+	// computed while a file is received, and reported in the
+	// FileResult passed to a FileCallbackFunc. Either, both, or neither
+	// may be set; each costs one extra hash pass over every fragment's
+	// bytes.
+	ComputeMD5    bool
+	ComputeSHA256 bool
+	// ReplyProtocol, if set, is the BITS-Supported-Protocols GUID for
+	// the upload-reply variant of the protocol. When a client's
+	// BITS-Supported-Protocols includes it, Create-Session negotiates
+	// upload-reply instead of plain upload: the session records the
+	// client's BITS-Reply-URL, and Close-Session delivers back whatever
+	// reply body the FileCallbackFunc returned for the uploaded file.
+	ReplyProtocol string
+}
+
+// Handler is an http.Handler implementing the BITS upload protocol.
+// Create one with NewHandler.
+type Handler struct {
+	cfg          *Config
+	callback     CallbackFunc
+	storage      Storage
+	sessionStore SessionStore
+	sessionGate  *sessionGate
+	fragmentSem  chan struct{}
+
+	auth              Authenticator
+	principalCallback PrincipalCallbackFunc
+	fileCallback      FileCallbackFunc
+
+	logger  *slog.Logger
+	metrics Metrics
+
+	activeSessions int64
+}
+
+// SetLogger installs l as the Handler's structured logger, replacing
+// the slog.Default() it otherwise logs to.
+func (b *Handler) SetLogger(l *slog.Logger) {
+	b.logger = l
+}
+
+// SetMetrics installs m as the Handler's Metrics sink, replacing the
+// no-op default. Use NewPrometheusMetrics to back it with Prometheus
+// collectors.
+func (b *Handler) SetMetrics(m Metrics) {
+	b.metrics = m
+}
+
+// adjustActiveSessions updates the active-session count by delta and
+// reports the new total via Metrics.
+func (b *Handler) adjustActiveSessions(delta int64) {
+	b.metrics.ActiveSessions(int(atomic.AddInt64(&b.activeSessions, delta)))
+}
+
+// SetAuthenticator installs auth as the Handler's Authenticator,
+// requiring every request to authenticate before packet dispatch. Pass
+// nil to disable authentication (the default).
+func (b *Handler) SetAuthenticator(auth Authenticator) {
+	b.auth = auth
+}
+
+// SetPrincipalCallback installs a PrincipalCallbackFunc, which takes
+// priority over any CallbackFunc passed to NewHandler for the lifetime
+// of the Handler.
+func (b *Handler) SetPrincipalCallback(cb PrincipalCallbackFunc) {
+	b.principalCallback = cb
+}
+
+// SetFileCallback installs a FileCallbackFunc, which takes priority
+// over PrincipalCallbackFunc and CallbackFunc for EventRecieveFile only.
+func (b *Handler) SetFileCallback(cb FileCallbackFunc) {
+	b.fileCallback = cb
+}
+
+// fireEvent notifies whichever callback is configured, preferring a
+// PrincipalCallbackFunc over a plain CallbackFunc.
+func (b *Handler) fireEvent(event Event, sessionID, path string, principal *Principal) {
+	if b.principalCallback != nil {
+		b.principalCallback(event, sessionID, path, principal)
+		return
+	}
+	if b.callback != nil {
+		b.callback(event, sessionID, path)
+	}
+}
+
+// fireFileEvent notifies whichever callback is configured of a received
+// file, preferring a FileCallbackFunc (which alone can return a reply
+// body) over the generic fireEvent dispatch.
+func (b *Handler) fireFileEvent(sessionID string, result FileResult, principal *Principal) []byte {
+	if b.fileCallback != nil {
+		return b.fileCallback(sessionID, result, principal)
+	}
+	b.fireEvent(EventRecieveFile, sessionID, result.Path, principal)
+	return nil
+}
+
+// NewHandler returns a Handler configured with cfg, storing sessions
+// under cfg.TempDir via LocalFS and tracking session state in an
+// in-process MemorySessionStore. callback may be nil if the caller does
+// not need session lifecycle notifications. Use NewHandlerWithStorage
+// or NewHandlerFull to plug in different Storage/SessionStore backends.
+func NewHandler(cfg *Config, callback CallbackFunc) *Handler {
+	return NewHandlerWithStorage(cfg, callback, NewLocalFS(cfg.TempDir))
+}
+
+// NewHandlerWithStorage returns a Handler configured with cfg, using
+// storage as its Storage backend instead of the LocalFS default, and
+// tracking session state in an in-process MemorySessionStore.
+func NewHandlerWithStorage(cfg *Config, callback CallbackFunc, storage Storage) *Handler {
+	return NewHandlerFull(cfg, callback, storage, NewMemorySessionStore())
+}
+
+// NewHandlerFull returns a Handler configured with cfg, storage and
+// sessionStore. Use this, with e.g. a BoltSessionStore, when sessions
+// need to survive a server restart.
+func NewHandlerFull(cfg *Config, callback CallbackFunc, storage Storage, sessionStore SessionStore) *Handler {
+	var fragmentSem chan struct{}
+	if cfg.MaxConcurrentFragments > 0 {
+		fragmentSem = make(chan struct{}, cfg.MaxConcurrentFragments)
+	}
+	return &Handler{
+		cfg:          cfg,
+		callback:     callback,
+		storage:      storage,
+		sessionStore: sessionStore,
+		sessionGate:  newSessionGate(cfg.MaxInflightPerSession),
+		fragmentSem:  fragmentSem,
+		logger:       slog.Default(),
+		metrics:      noopMetrics{},
+	}
+}
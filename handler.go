@@ -1,33 +1,87 @@
 package gobits
 
 import (
-	"io/ioutil"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
 	"net/http"
 	"net/http/httputil"
-	"os"
 	"path"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
-	"log"
+	"sync"
+	"time"
 )
 
+// fragmentBufSize is the size of the buffers used to stream fragment
+// bodies to disk. Kept small and pooled so a handler serving many
+// concurrent BITS uploads doesn't balloon memory the way reading the
+// whole fragment into a byte slice did.
+const fragmentBufSize = 64 * 1024
+
+// fragmentBufPool holds reusable buffers for io.CopyBuffer so per-request
+// allocation stays bounded regardless of fragment size.
+var fragmentBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, fragmentBufSize)
+		return &buf
+	},
+}
+
+// offsetWriter adapts a FragmentWriter's WriteAt to the io.Writer
+// interface expected by io.CopyBuffer. Each Write call lands at the
+// next absolute offset rather than wherever the destination's cursor
+// happens to be, which lets bitsFragment write fragments without
+// relying on O_APPEND. A running CRC-32 of everything written is kept
+// alongside the copy, along with whichever of md5/sha256 are enabled
+// via Config.ComputeMD5/Config.ComputeSHA256.
+type offsetWriter struct {
+	dst     FragmentWriter
+	offset  uint64
+	written uint64
+	crc     hash.Hash32
+	md5     hash.Hash
+	sha256  hash.Hash
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.dst.WriteAt(p, int64(ow.offset+ow.written))
+	ow.written += uint64(n)
+	ow.crc.Write(p[:n])
+	if ow.md5 != nil {
+		ow.md5.Write(p[:n])
+	}
+	if ow.sha256 != nil {
+		ow.sha256.Write(p[:n])
+	}
+	return n, err
+}
+
 // ServeHTTP handler
 func (b *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-        dump, err := httputil.DumpRequest(r, false)
+	dump, err := httputil.DumpRequest(r, false)
 	if err != nil {
-		log.Printf("")
+		b.logger.Error("failed to dump request", "error", err)
 		http.Error(w, "Internal Server error", http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Request:\n%s", dump)
+	b.logger.Debug("request", "dump", string(dump))
 	// Only allow BITS requests
 	if r.Method != b.cfg.AllowedMethod {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	// Authenticate before dispatching to any packet handler
+	principal, ok := b.authenticate(w, r)
+	if !ok {
+		return
+	}
+
 	// get packet type and session id
 	packetType := strings.ToLower(r.Header.Get("BITS-Packet-Type"))
 	sessionID := r.Header.Get("BITS-Session-Id")
@@ -35,23 +89,23 @@ func (b *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Take appropriate action based on what type of packet we got
 	switch packetType {
 	case "ping":
-		log.Printf("ping request: %s", r)
+		b.logger.Debug("ping request", "session", sessionID)
 		b.bitsPing(w, r)
 		return
 	case "create-session":
-		log.Printf("create-session request: %s", r)
-		b.bitsCreate(w, r)
+		b.logger.Debug("create-session request", "session", sessionID)
+		b.bitsCreate(w, r, principal)
 	case "cancel-session":
-		log.Printf("cancel-session request: %s", r)
-		b.bitsCancel(w, r, sessionID)
+		b.logger.Debug("cancel-session request", "session", sessionID)
+		b.bitsCancel(w, r, sessionID, principal)
 	case "close-session":
-		log.Printf("close-session request: %s", r)
-		b.bitsClose(w, r, sessionID)
+		b.logger.Debug("close-session request", "session", sessionID)
+		b.bitsClose(w, r, sessionID, principal)
 	case "fragment":
-		log.Printf("fragment request: %s", r)
-		b.bitsFragment(w, r, sessionID)
+		b.logger.Debug("fragment request", "session", sessionID)
+		b.bitsFragment(w, r, sessionID, principal)
 	default:
-		log.Printf("error occured: %s", r)
+		b.logger.Warn("unrecognized BITS-Packet-Type", "packetType", packetType, "session", sessionID)
 		bitsError(w, "", http.StatusBadRequest, 0, ErrorContextRemoteFile)
 	}
 }
@@ -65,23 +119,27 @@ func (b *Handler) bitsPing(w http.ResponseWriter, r *http.Request) {
 
 // use the Create-Session packet to request an upload session with the BITS server.
 // https://msdn.microsoft.com/en-us/library/aa362833(v=vs.85).aspx
-func (b *Handler) bitsCreate(w http.ResponseWriter, r *http.Request) {
+func (b *Handler) bitsCreate(w http.ResponseWriter, r *http.Request, principal *Principal) {
 
-	// Check for correct protocol
+	// Check for correct protocol, accepting either the plain upload
+	// protocol or, if configured, the upload-reply variant.
 	var protocol string
+	var isReply bool
 	protocols := strings.Split(r.Header.Get("BITS-Supported-Protocols"), " ")
-	log.Printf("all protocols from request: %s", protocols)
-	for _, protocol = range protocols {
-		if protocol == b.cfg.Protocol {
-			log.Printf("bitsCreate break taken!")
+	for _, p := range protocols {
+		if p == b.cfg.Protocol {
+			protocol = p
+			break
+		}
+		if b.cfg.ReplyProtocol != "" && p == b.cfg.ReplyProtocol {
+			protocol = p
+			isReply = true
 			break
 		}
 	}
-	log.Printf("configured protocol from config: %s", b.cfg.Protocol)
-	log.Printf("protocol from request: %s", protocol)
-	if protocol != b.cfg.Protocol {
+	if protocol == "" {
 		// no matching protocol found
-		log.Printf("Create-Session: no matching protocol found. %s", r)
+		b.logger.Warn("create-session: no matching protocol found", "offered", protocols, "accepted", b.cfg.Protocol, "acceptedReply", b.cfg.ReplyProtocol)
 		bitsError(w, "", http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
@@ -89,25 +147,35 @@ func (b *Handler) bitsCreate(w http.ResponseWriter, r *http.Request) {
 	// Create new session UUID
 	uuid, err := newUUID()
 	if err != nil {
-		log.Printf("Error creating new session UUID: %s", err.Error())
+		b.logger.Error("error creating new session UUID", "error", err)
 		bitsError(w, "", http.StatusInternalServerError, 0, ErrorContextRemoteFile)
 		return
 	}
-	log.Printf("New SessionID: %s", uuid)
 
-	// Create session directory
-	tmpDir := path.Join(b.cfg.TempDir, uuid)
-	if err = os.MkdirAll(tmpDir, 0755); err != nil {
-		log.Printf("error mkdirAll: %s", err.Error())
+	// Allocate storage for the new session
+	session, err := b.storage.CreateSession(uuid)
+	if err != nil {
+		b.logger.Error("error creating session storage", "session", uuid, "error", err)
 		bitsError(w, "", http.StatusInternalServerError, 0, ErrorContextRemoteFile)
 		return
 	}
-	log.Printf("tmpDir '%s' have been created", tmpDir)
+	b.logger.Info("session created", "session", uuid, "path", session.Path(), "protocol", protocol, "principal", principalName(principal))
 
-	// make sure we actually have a callback before calling it
-	if b.callback != nil {
-		b.callback(EventCreateSession, uuid, tmpDir)
+	// Record the session so it survives a restart and so fragment
+	// handling can track received byte ranges.
+	newSess := newSession(uuid, protocol, session.Path())
+	newSess.Principal = principalName(principal)
+	if isReply {
+		newSess.ReplyURL = r.Header.Get("BITS-Reply-URL")
 	}
+	if err = b.sessionStore.Create(newSess); err != nil {
+		b.logger.Error("error recording session state", "session", uuid, "error", err)
+		bitsError(w, "", http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+		return
+	}
+	b.adjustActiveSessions(1)
+
+	b.fireEvent(EventCreateSession, uuid, session.Path(), principal)
 
 	// https://msdn.microsoft.com/en-us/library/aa362771(v=vs.85).aspx
 	w.Header().Add("BITS-Packet-Type", "Ack")
@@ -120,55 +188,58 @@ func (b *Handler) bitsCreate(w http.ResponseWriter, r *http.Request) {
 
 // Use the Fragment packet to send a fragment of the upload file to the server
 // https://msdn.microsoft.com/en-us/library/aa362842(v=vs.85).aspx
-func (b *Handler) bitsFragment(w http.ResponseWriter, r *http.Request, uuid string) {
+func (b *Handler) bitsFragment(w http.ResponseWriter, r *http.Request, uuid string, principal *Principal) {
 
 	// Check for correct session
 	if uuid == "" || !isValidUUID(uuid) {
-		log.Printf("session UUID ('%s') is empty or invalid", uuid)
+		b.logger.Warn("fragment: session UUID is empty or invalid", "session", uuid)
 		bitsError(w, "", http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
 
 	// Check for existing session
-	var srcDir string
-	srcDir = path.Join(b.cfg.TempDir, uuid)
-	if b, _ := exists(srcDir); !b {
-		log.Printf("srcDir does not exist")
+	var err error
+	sess, sessionExists, err := b.sessionStore.Get(uuid)
+	if err != nil {
+		b.logger.Error("error checking session storage", "session", uuid, "error", err)
 		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
-	// Create session directory
-	//tmpDir := path.Join(b.cfg.TempDir, uuid)
-	var err error
-	if err = os.MkdirAll(srcDir, 0755); err != nil {
-		log.Printf("error mkdirAll: %s", err.Error())
-		bitsError(w, "", http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+	if !sessionExists {
+		b.logger.Warn("fragment: session storage does not exist", "session", uuid)
+		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+		return
+	}
+	if !b.authorizeSession(w, uuid, principal, sess) {
 		return
 	}
-	log.Printf("srcDir '%s' have been created", srcDir)
 
 	// Get filename and make sure the path is correct
 	_, filename := path.Split(r.RequestURI)
 	if filename == "" {
-		log.Printf("path is not correct")
+		b.logger.Warn("fragment: request path has no filename", "session", uuid)
 		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
 
-	//var err error
 	var match bool
 
+	// Resolve the allow/deny lists to check filename against, letting
+	// the Authenticator override the global cfg lists per-user.
+	allowedList, disallowedList := b.allowedAndDisallowed(principal, filename)
+
 	// See if filename is blacklisted. If so, return an error
-	for _, reg := range b.cfg.Disallowed {
+	for _, reg := range disallowedList {
 		match, err = regexp.MatchString(reg, filename)
 		if err != nil {
-			log.Printf("error matching disallowed filename")
+			b.logger.Error("error matching disallowed filename", "session", uuid, "pattern", reg, "error", err)
 			bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 			return
 		}
 		if match {
 			// File is blacklisted
-			log.Printf("filename ('%s') is blacklisted", filename)
+			b.logger.Warn("fragment: filename is blacklisted", "session", uuid, "filename", filename)
+			b.metrics.FragmentReceived(OutcomeBlacklisted, 0)
 			bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 			return
 		}
@@ -176,10 +247,10 @@ func (b *Handler) bitsFragment(w http.ResponseWriter, r *http.Request, uuid stri
 
 	// See if filename is whitelisted
 	allowed := false
-	for _, reg := range b.cfg.Allowed {
+	for _, reg := range allowedList {
 		match, err = regexp.MatchString(reg, filename)
 		if err != nil {
-			log.Printf("error matching allowed filename")
+			b.logger.Error("error matching allowed filename", "session", uuid, "pattern", reg, "error", err)
 			bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 			return
 		}
@@ -190,31 +261,26 @@ func (b *Handler) bitsFragment(w http.ResponseWriter, r *http.Request, uuid stri
 	}
 	if !allowed {
 		// No whitelisting rules matched!
-		log.Printf("filename ('%s') is not whitelisted", filename)
+		b.logger.Warn("fragment: filename is not whitelisted", "session", uuid, "filename", filename)
+		b.metrics.FragmentReceived(OutcomeBlacklisted, 0)
 		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
 
-	var src string
-
-	// Get absolute paths to file
-	src, err = filepath.Abs(filepath.Join(srcDir, filename))
-	if err != nil {
-		src = filepath.Join(srcDir, filename)
-	}
-
 	// Parse range
 	var rangeStart, rangeEnd, fileLength uint64
 	rangeStart, rangeEnd, fileLength, err = parseRange(r.Header.Get("Content-Range"))
 	if err != nil {
-		log.Printf("error parsing range: %s", err.Error())
+		b.logger.Warn("error parsing range", "session", uuid, "error", err)
+		b.metrics.FragmentReceived(OutcomeRangeError, 0)
 		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
 
 	// Check filesize
 	if b.cfg.MaxSize > 0 && fileLength > b.cfg.MaxSize {
-		log.Printf("file is too big, max allowed size is: %s", b.cfg.MaxSize)
+		b.logger.Warn("fragment: file exceeds MaxSize", "session", uuid, "declaredLength", fileLength, "maxSize", b.cfg.MaxSize)
+		b.metrics.FragmentReceived(OutcomeTooLarge, 0)
 		bitsError(w, uuid, http.StatusRequestEntityTooLarge, 0, ErrorContextRemoteFile)
 		return
 	}
@@ -223,109 +289,160 @@ func (b *Handler) bitsFragment(w http.ResponseWriter, r *http.Request, uuid stri
 	var fragmentSize uint64
 	fragmentSize, err = strconv.ParseUint(r.Header.Get("Content-Length"), 10, 64)
 	if err != nil {
-		log.Printf("error parsing fragmentSize")
+		b.logger.Warn("error parsing fragmentSize", "session", uuid, "error", err)
 		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
 
-	// Get posted data and confirm size
-	data, err := ioutil.ReadAll(r.Body) // should probably not read everything into memory like this
-	if err != nil {
-		log.Printf("error reading data: %s", err.Error())
+	// Check that content-range size matches content-length
+	if rangeEnd-rangeStart+1 != fragmentSize {
+		b.logger.Warn("fragment: range size does not match fragmentSize", "session", uuid, "rangeStart", rangeStart, "rangeEnd", rangeEnd, "fragmentSize", fragmentSize)
+		b.metrics.FragmentReceived(OutcomeRangeError, 0)
 		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
-	if uint64(len(data)) != fragmentSize {
-		log.Printf("error: size of data is not equal to fragmentSize")
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+
+	// Serialize fragment writes for this session (different sessions
+	// stay fully parallel) and bound total concurrent fragment writes
+	// across all sessions.
+	gateEntry, err := b.sessionGate.lock(uuid)
+	if err != nil {
+		b.logger.Warn("error acquiring session gate", "session", uuid, "error", err)
+		bitsError(w, uuid, http.StatusServiceUnavailable, 0, ErrorContextRemoteFile)
 		return
 	}
+	defer b.sessionGate.unlock(uuid, gateEntry)
 
-	// Check that content-range size matches content-length
-	if rangeEnd-rangeStart+1 != fragmentSize {
-		log.Printf("error: range size does not match fragmentSize")
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
-		return
+	if b.fragmentSem != nil {
+		b.fragmentSem <- struct{}{}
+		defer func() { <-b.fragmentSem }()
 	}
 
-	// Open or create file
-	var file *os.File
+	// Get the size already on disk for this filename via the storage
+	// backend, then open it for writing at whatever absolute offset
+	// this fragment needs.
 	var fileSize uint64
-	var exist bool
-	exist, err = exists(src)
+	fileSize, err = b.storage.Stat(uuid, filename)
 	if err != nil {
-		log.Printf("error: src file exists: %s", err.Error())
-		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+		b.logger.Error("error statting file", "session", uuid, "filename", filename, "error", err)
+		bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
 		return
 	}
-	if exist != true {
-		// Create file
-		file, err = os.OpenFile(src, os.O_CREATE|os.O_WRONLY, 0755)
-		if err != nil {
-			log.Printf("error creating new file ('%s'): %s", src, err.Error())
-			bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
-			return
-		}
-		defer file.Close()
-
-		// New file, size is zero
-		fileSize = 0
-
-	} else {
-		// Open file for append
-		file, err = os.OpenFile(src, os.O_APPEND|os.O_WRONLY, 0755)
-		if err != nil {
-			log.Printf("error appending to file ('%s'): %s", src, err.Error())
-			bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
-			return
-		}
-		defer file.Close()
-
-		// Get size on disk
-		var info os.FileInfo
-		info, err = file.Stat()
-		if err != nil {
-			log.Printf("error getting file stat: %s", err.Error())
-			bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
-			return
-		}
-		fileSize = uint64(info.Size())
-
+	fw, err := b.storage.OpenFragment(uuid, filename)
+	if err != nil {
+		b.logger.Error("error opening file", "session", uuid, "filename", filename, "error", err)
+		bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+		return
 	}
+	defer fw.Close()
 
 	// Sanity checks
 	if rangeEnd < fileSize {
 		// The range is already written to disk
-		log.Printf("range already written to disk")
+		b.logger.Warn("fragment: range already written to disk", "session", uuid, "filename", filename)
+		b.metrics.FragmentReceived(OutcomeRangeError, 0)
 		w.Header().Add("BITS-Recieved-Content-Range", strconv.FormatUint(fileSize, 10))
 		bitsError(w, uuid, http.StatusRequestedRangeNotSatisfiable, 0, ErrorContextRemoteFile)
 		return
 	} else if rangeStart > fileSize {
 		// start must be <= fileSize, else there will be a gap
-		log.Printf("gap in file detected")
+		b.logger.Warn("fragment: gap in file detected", "session", uuid, "filename", filename, "haveSize", fileSize, "rangeStart", rangeStart)
+		b.metrics.FragmentReceived(OutcomeRangeError, 0)
 		w.Header().Add("BITS-Recieved-Content-Range", strconv.FormatUint(fileSize, 10))
 		bitsError(w, uuid, http.StatusRequestedRangeNotSatisfiable, 0, ErrorContextRemoteFile)
 		return
 	}
 
-	// Calculate the offset in the slice, if overlapping
+	// dataOffset is how many leading bytes of this fragment were already
+	// written to disk by an earlier, overlapping fragment; skip them on
+	// the wire instead of buffering them.
 	var dataOffset = fileSize - rangeStart
+	if dataOffset > 0 {
+		if _, err = io.CopyN(io.Discard, r.Body, int64(dataOffset)); err != nil {
+			b.logger.Warn("error discarding overlapping bytes", "session", uuid, "error", err)
+			bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
+			return
+		}
+	}
 
-	// Write the data to file
-	var written uint64
-	var wr int
-	wr, err = file.Write(data[dataOffset:])
+	// Resume the configured content digests from whatever state was
+	// persisted after the previous fragment, if any. sess was fetched
+	// before the session gate was acquired, so it may already be stale
+	// by the time a pipelined request gets here; re-fetch it now that
+	// we hold the gate so the hash state lines up with fileSize, which
+	// was read under the same lock. A resumed upload whose state can't
+	// be recovered (e.g. it predates this feature) simply stops
+	// producing that digest for this file.
+	gatedSess, _, err := b.sessionStore.Get(uuid)
 	if err != nil {
-		log.Printf("error writing file: %s", err.Error())
+		b.logger.Error("error re-checking session storage", "session", uuid, "error", err)
 		bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
 		return
 	}
-	written = uint64(wr)
-	log.Printf("%d bytes written", written)
+	var fileHashState map[string][]byte
+	if fs, ok := gatedSess.Files[filename]; ok {
+		fileHashState = fs.HashState
+	}
+	var md5Hash, sha256Hash hash.Hash
+	var md5Valid, sha256Valid bool
+	if b.cfg.ComputeMD5 {
+		md5Hash, md5Valid = restoreHash(md5.New, fileHashState["md5"], fileSize)
+	}
+	if b.cfg.ComputeSHA256 {
+		sha256Hash, sha256Valid = restoreHash(sha256.New, fileHashState["sha256"], fileSize)
+	}
+
+	// Stream the remainder of the fragment straight to the file at its
+	// absolute offset using a pooled buffer, so per-request memory use
+	// stays bounded regardless of fragment size. A running CRC-32 and,
+	// if configured, md5/sha256 are kept alongside the copy.
+	ow := &offsetWriter{dst: fw, offset: fileSize, crc: crc32.NewIEEE()}
+	if md5Valid {
+		ow.md5 = md5Hash
+	}
+	if sha256Valid {
+		ow.sha256 = sha256Hash
+	}
+	bufp := fragmentBufPool.Get().(*[]byte)
+	writeStart := time.Now()
+	wr, err := io.CopyBuffer(ow, io.LimitReader(r.Body, int64(fragmentSize-dataOffset)), *bufp)
+	b.metrics.FragmentWriteDuration(time.Since(writeStart))
+	fragmentBufPool.Put(bufp)
+	if err != nil {
+		b.logger.Error("error writing file", "session", uuid, "filename", filename, "error", err)
+		bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+		return
+	}
+	written := uint64(wr)
+	b.logger.Debug("fragment written", "session", uuid, "filename", filename, "bytes", written, "crc32", ow.crc.Sum32())
+
+	// Persist whatever digest state is still valid so the next fragment
+	// (or a server restart, with a durable SessionStore) can resume it.
+	if md5Valid || sha256Valid {
+		state := make(map[string][]byte, 2)
+		if md5Valid {
+			state["md5"] = marshalHash(md5Hash)
+		}
+		if sha256Valid {
+			state["sha256"] = marshalHash(sha256Hash)
+		}
+		if err = b.sessionStore.UpdateHashState(uuid, filename, state); err != nil {
+			b.logger.Error("error persisting hash state", "session", uuid, "filename", filename, "error", err)
+		}
+	}
 
 	// Make sure we wrote everything we wanted
 	if written != fragmentSize-dataOffset {
-		log.Printf("writing less data than expected")
+		b.logger.Error("fragment: wrote less data than expected", "session", uuid, "filename", filename, "wrote", written, "want", fragmentSize-dataOffset)
+		bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+		return
+	}
+	b.metrics.FragmentReceived(OutcomeOK, written)
+
+	// Record the received range and refresh last-activity so the
+	// janitor doesn't expire an upload that's still progressing.
+	if err = b.sessionStore.UpdateFragment(uuid, filename, rangeStart, rangeEnd, fileLength); err != nil {
+		b.logger.Error("error updating session state", "session", uuid, "filename", filename, "error", err)
 		bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
 		return
 	}
@@ -333,49 +450,98 @@ func (b *Handler) bitsFragment(w http.ResponseWriter, r *http.Request, uuid stri
 	// Check if we have written everything
 	if rangeEnd+1 == fileLength {
 		// File is done! Manually close it, since the callback probably don't wnat the file to be open
-		file.Close()
+		fw.Close()
+
+		// Finalize in the storage backend and hand the final path/key
+		// to the callback.
+		finalPath, err := b.storage.Finalize(uuid, filename)
+		if err != nil {
+			b.logger.Error("error finalizing file", "session", uuid, "filename", filename, "error", err)
+			bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+			return
+		}
 
-		// Call the callback
-		if b.callback != nil {
-			b.callback(EventRecieveFile, uuid, src)
+		result := FileResult{Path: finalPath, Size: fileLength}
+		if md5Valid {
+			result.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+		}
+		if sha256Valid {
+			result.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
+		}
+		b.logger.Info("file received", "session", uuid, "filename", filename, "path", finalPath, "size", fileLength, "md5", result.MD5, "sha256", result.SHA256)
+		if reply := b.fireFileEvent(uuid, result, principal); len(reply) > 0 {
+			if err = b.sessionStore.SetReply(uuid, reply); err != nil {
+				b.logger.Error("error recording reply body", "session", uuid, "error", err)
+			}
 		}
+	}
 
+	// Report how many contiguous bytes from the start of the file have
+	// actually been received, per the tracked intervals, rather than
+	// assuming this fragment extended a single contiguous run.
+	receivedRange := fileSize + written
+	if sess, ok, err := b.sessionStore.Get(uuid); err == nil && ok {
+		if f, ok := sess.Files[filename]; ok {
+			receivedRange = f.Size()
+		}
 	}
 
 	// https://msdn.microsoft.com/en-us/library/aa362773(v=vs.85).aspx
 	w.Header().Add("BITS-Packet-Type", "Ack")
 	w.Header().Add("BITS-Session-Id", uuid)
-	w.Header().Add("BITS-Received-Content-Range", strconv.FormatUint(fileSize+uint64(written), 10))
+	w.Header().Add("BITS-Received-Content-Range", strconv.FormatUint(receivedRange, 10))
 	w.Write(nil)
 
 }
 
 // Use the Cancel-Session packet to terminate the upload session with the BITS server.
 // https://msdn.microsoft.com/en-us/library/aa362829(v=vs.85).aspx
-func (b *Handler) bitsCancel(w http.ResponseWriter, r *http.Request, uuid string) {
+func (b *Handler) bitsCancel(w http.ResponseWriter, r *http.Request, uuid string, principal *Principal) {
 	// Check for correct session
 	if uuid == "" || !isValidUUID(uuid) {
-		log.Printf("bitsCancel error, uuid ('%s') empty or not valid", uuid)
+		b.logger.Warn("cancel-session: uuid is empty or invalid", "session", uuid)
 		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
-	destDir := path.Join(b.cfg.TempDir, uuid)
-	exist, err := exists(destDir)
+	sess, exist, err := b.sessionStore.Get(uuid)
 	if err != nil {
-		log.Printf("error checking if dstDir already exists: %s", err.Error())
+		b.logger.Error("error checking if session storage exists", "session", uuid, "error", err)
 		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
 	if !exist {
-		log.Printf("dstDir does not exist")
+		b.logger.Warn("cancel-session: session storage does not exist", "session", uuid)
 		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
+	if !b.authorizeSession(w, uuid, principal, sess) {
+		return
+	}
 
-	// do the callback
-	if b.callback != nil {
-		b.callback(EventCancelSession, uuid, destDir)
+	// Hold the same per-session gate Fragment does so a Cancel-Session
+	// can't race a Fragment request still mid-write for this session.
+	gateEntry, err := b.sessionGate.lock(uuid)
+	if err != nil {
+		b.logger.Warn("error acquiring session gate", "session", uuid, "error", err)
+		bitsError(w, uuid, http.StatusServiceUnavailable, 0, ErrorContextRemoteFile)
+		return
 	}
+	defer b.sessionGate.unlock(uuid, gateEntry)
+
+	if err = b.storage.Remove(uuid); err != nil {
+		b.logger.Error("error removing session storage", "session", uuid, "error", err)
+		bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+		return
+	}
+	if err = b.sessionStore.Delete(uuid); err != nil {
+		b.logger.Error("error removing session state", "session", uuid, "error", err)
+		bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+		return
+	}
+	b.adjustActiveSessions(-1)
+	b.metrics.SessionClosed(time.Since(sess.CreatedAt))
+
+	b.fireEvent(EventCancelSession, uuid, sess.Dir, principal)
 
 	w.Header().Add("BITS-Packet-Type", "Ack")
 	w.Header().Add("BITS-Session-Id", uuid)
@@ -384,33 +550,58 @@ func (b *Handler) bitsCancel(w http.ResponseWriter, r *http.Request, uuid string
 
 // Use the Close-Session packet to tell the BITS server that file upload is complete and to end the session.
 // https://msdn.microsoft.com/en-us/library/aa362830(v=vs.85).aspx
-func (b *Handler) bitsClose(w http.ResponseWriter, r *http.Request, uuid string) {
+func (b *Handler) bitsClose(w http.ResponseWriter, r *http.Request, uuid string, principal *Principal) {
 	// Check for correct session
 	if uuid == "" || !isValidUUID(uuid) {
-		log.Printf("bitsClose error, uuid ('%s') empty or not valid", uuid)
+		b.logger.Warn("close-session: uuid is empty or invalid", "session", uuid)
 		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
-	destDir := path.Join(b.cfg.TempDir, uuid)
-	exist, err := exists(destDir)
+	sess, exist, err := b.sessionStore.Get(uuid)
 	if err != nil {
-		log.Printf("error checking if dstDir already exists: %s", err.Error())
+		b.logger.Error("error checking if session storage exists", "session", uuid, "error", err)
 		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
 	if !exist {
-		log.Printf("dstDir does not exist")
+		b.logger.Warn("close-session: session storage does not exist", "session", uuid)
 		bitsError(w, uuid, http.StatusBadRequest, 0, ErrorContextRemoteFile)
 		return
 	}
+	if !b.authorizeSession(w, uuid, principal, sess) {
+		return
+	}
+
+	// Hold the same per-session gate Fragment does so a Close-Session
+	// can't race a Fragment request still mid-write for this session.
+	gateEntry, err := b.sessionGate.lock(uuid)
+	if err != nil {
+		b.logger.Warn("error acquiring session gate", "session", uuid, "error", err)
+		bitsError(w, uuid, http.StatusServiceUnavailable, 0, ErrorContextRemoteFile)
+		return
+	}
+	defer b.sessionGate.unlock(uuid, gateEntry)
 
-	// do the callback
-	if b.callback != nil {
-		b.callback(EventCloseSession, uuid, destDir)
+	if err = b.sessionStore.Delete(uuid); err != nil {
+		b.logger.Error("error removing session state", "session", uuid, "error", err)
+		bitsError(w, uuid, http.StatusInternalServerError, 0, ErrorContextRemoteFile)
+		return
 	}
+	b.adjustActiveSessions(-1)
+	b.metrics.SessionClosed(time.Since(sess.CreatedAt))
+
+	b.fireEvent(EventCloseSession, uuid, sess.Dir, principal)
 
 	// https://msdn.microsoft.com/en-us/library/aa362712(v=vs.85).aspx
 	w.Header().Add("BITS-Packet-Type", "Ack")
 	w.Header().Add("BITS-Session-Id", uuid)
+	// Per the BITS upload-reply protocol, a session negotiated with
+	// Config.ReplyProtocol carries the server's application-defined
+	// reply as the body of the Close-Session response.
+	if b.cfg.ReplyProtocol != "" && sess.Protocol == b.cfg.ReplyProtocol && len(sess.Reply) > 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(sess.Reply)))
+		w.Write(sess.Reply)
+		return
+	}
 	w.Write(nil)
 }
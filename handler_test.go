@@ -0,0 +1,188 @@
+package gobits
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// memFragmentWriter is an in-memory FragmentWriter that records every
+// WriteAt call, so offsetWriter's absolute-offset behavior can be
+// checked without touching disk.
+type memFragmentWriter struct {
+	data  []byte
+	calls []struct {
+		off int64
+		n   int
+	}
+}
+
+func (m *memFragmentWriter) WriteAt(p []byte, off int64) (int, error) {
+	end := int(off) + len(p)
+	if end > len(m.data) {
+		grown := make([]byte, end)
+		copy(grown, m.data)
+		m.data = grown
+	}
+	copy(m.data[off:], p)
+	m.calls = append(m.calls, struct {
+		off int64
+		n   int
+	}{off, len(p)})
+	return len(p), nil
+}
+
+func (m *memFragmentWriter) Close() error { return nil }
+
+func TestOffsetWriterWritesAtAbsoluteOffset(t *testing.T) {
+	dst := &memFragmentWriter{}
+	ow := &offsetWriter{dst: dst, offset: 10, crc: crc32.NewIEEE(), md5: md5.New(), sha256: sha256.New()}
+
+	chunks := [][]byte{[]byte("hello, "), []byte("offset "), []byte("world")}
+	var want []byte
+	for _, c := range chunks {
+		n, err := ow.Write(c)
+		if err != nil {
+			t.Fatalf("Write(%q) error = %v", c, err)
+		}
+		if n != len(c) {
+			t.Fatalf("Write(%q) n = %d, want %d", c, n, len(c))
+		}
+		want = append(want, c...)
+	}
+
+	// Every write should have landed at offset+written at the time it
+	// was made, i.e. immediately following the previous write, not at
+	// the destination's own cursor.
+	wantOff := int64(10)
+	for i, call := range dst.calls {
+		if call.off != wantOff {
+			t.Errorf("call %d: WriteAt offset = %d, want %d", i, call.off, wantOff)
+		}
+		wantOff += int64(call.n)
+	}
+
+	if got := string(dst.data[10:]); got != string(want) {
+		t.Errorf("dst content = %q, want %q", got, want)
+	}
+
+	if got, want := ow.crc.Sum32(), crc32.ChecksumIEEE(want); got != want {
+		t.Errorf("crc32 = %x, want %x", got, want)
+	}
+	if got, want := ow.md5.Sum(nil), md5.Sum(want); string(got) != string(want[:]) {
+		t.Errorf("md5 = %x, want %x", got, want)
+	}
+	if got, want := ow.sha256.Sum(nil), sha256.Sum256(want); string(got) != string(want[:]) {
+		t.Errorf("sha256 = %x, want %x", got, want)
+	}
+}
+
+func TestOffsetWriterOmitsUnconfiguredDigests(t *testing.T) {
+	dst := &memFragmentWriter{}
+	ow := &offsetWriter{dst: dst, crc: crc32.NewIEEE()}
+
+	if _, err := ow.Write([]byte("data")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if ow.md5 != nil || ow.sha256 != nil {
+		t.Fatal("md5/sha256 should stay nil when Config.ComputeMD5/ComputeSHA256 are unset")
+	}
+}
+
+// newTestHandler returns a Handler wired to a LocalFS under t.TempDir(),
+// with cb receiving every lifecycle event.
+func newTestHandler(t *testing.T, cb CallbackFunc) *Handler {
+	t.Helper()
+	cfg := &Config{
+		AllowedMethod: "BITS_POST",
+		Protocol:      "{7df0354d-249b-430f-820d-3d2a9bef4931}",
+		TempDir:       t.TempDir(),
+		Allowed:       []string{`.*`},
+		ComputeMD5:    true,
+	}
+	return NewHandler(cfg, cb)
+}
+
+func TestHandlerCreateFragmentCloseRoundTrip(t *testing.T) {
+	var events []Event
+	h := newTestHandler(t, func(event Event, sessionID, path string) {
+		events = append(events, event)
+	})
+
+	const content = "round trip payload"
+
+	// Create-Session
+	createReq := httptest.NewRequest("BITS_POST", "/upload/file.txt", nil)
+	createReq.Header.Set("BITS-Packet-Type", "Create-Session")
+	createReq.Header.Set("BITS-Supported-Protocols", h.cfg.Protocol)
+	createRec := httptest.NewRecorder()
+	h.ServeHTTP(createRec, createReq)
+	if createRec.Code != 200 {
+		t.Fatalf("Create-Session status = %d, body = %q", createRec.Code, createRec.Body.String())
+	}
+	sessionID := createRec.Header().Get("BITS-Session-Id")
+	if sessionID == "" {
+		t.Fatal("Create-Session response missing BITS-Session-Id")
+	}
+
+	// Fragment
+	fragReq := httptest.NewRequest("BITS_POST", "/upload/file.txt", strings.NewReader(content))
+	fragReq.Header.Set("BITS-Packet-Type", "Fragment")
+	fragReq.Header.Set("BITS-Session-Id", sessionID)
+	fragReq.Header.Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+	fragReq.Header.Set("Content-Length", fmt.Sprintf("%d", len(content)))
+	fragReq.ContentLength = int64(len(content))
+	fragRec := httptest.NewRecorder()
+	h.ServeHTTP(fragRec, fragReq)
+	if fragRec.Code != 200 {
+		t.Fatalf("Fragment status = %d, body = %q", fragRec.Code, fragRec.Body.String())
+	}
+	if got, want := fragRec.Header().Get("BITS-Received-Content-Range"), fmt.Sprintf("%d", len(content)); got != want {
+		t.Errorf("BITS-Received-Content-Range = %q, want %q", got, want)
+	}
+
+	// Close-Session
+	closeReq := httptest.NewRequest("BITS_POST", "/upload/file.txt", nil)
+	closeReq.Header.Set("BITS-Packet-Type", "Close-Session")
+	closeReq.Header.Set("BITS-Session-Id", sessionID)
+	closeRec := httptest.NewRecorder()
+	h.ServeHTTP(closeRec, closeReq)
+	if closeRec.Code != 200 {
+		t.Fatalf("Close-Session status = %d, body = %q", closeRec.Code, closeRec.Body.String())
+	}
+
+	if got, want := events, []Event{EventCreateSession, EventRecieveFile, EventCloseSession}; !eventsEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+
+	finalPath := filepath.Join(h.cfg.TempDir, sessionID, "file.txt")
+	got, err := os.ReadFile(finalPath)
+	if err != nil {
+		t.Fatalf("ReadFile(%q) error = %v", finalPath, err)
+	}
+	if string(got) != content {
+		t.Errorf("final file content = %q, want %q", got, content)
+	}
+
+	if _, ok, err := h.sessionStore.Get(sessionID); err != nil || ok {
+		t.Errorf("sessionStore.Get() after Close-Session: ok = %v, err = %v, want ok = false", ok, err)
+	}
+}
+
+func eventsEqual(a, b []Event) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
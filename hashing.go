@@ -0,0 +1,44 @@
+package gobits
+
+import (
+	"encoding"
+	"hash"
+)
+
+// restoreHash returns a fresh hash from newHash, resumed from state if
+// resumeOffset is non-zero. ok is false if resumeOffset is non-zero but
+// state couldn't be used to resume (no saved state, or the hash
+// implementation doesn't support marshaling), meaning the digest can no
+// longer be trusted for this file and the caller should stop feeding it
+// further writes.
+func restoreHash(newHash func() hash.Hash, state []byte, resumeOffset uint64) (h hash.Hash, ok bool) {
+	h = newHash()
+	if resumeOffset == 0 {
+		return h, true
+	}
+	if state == nil {
+		return h, false
+	}
+	u, isUnmarshaler := h.(encoding.BinaryUnmarshaler)
+	if !isUnmarshaler {
+		return h, false
+	}
+	if err := u.UnmarshalBinary(state); err != nil {
+		return h, false
+	}
+	return h, true
+}
+
+// marshalHash returns h's MarshalBinary output, or nil if h doesn't
+// support marshaling.
+func marshalHash(h hash.Hash) []byte {
+	m, ok := h.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	state, err := m.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	return state
+}
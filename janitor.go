@@ -0,0 +1,95 @@
+package gobits
+
+import (
+	"time"
+)
+
+// Janitor periodically expires sessions that have been idle for longer
+// than TTL, removing their storage and session record and firing
+// EventCancelSession so callers learn about the expiry the same way
+// they would a client-initiated Cancel-Session.
+type Janitor struct {
+	handler  *Handler
+	ttl      time.Duration
+	interval time.Duration
+	stop     chan struct{}
+}
+
+// NewJanitor returns a Janitor that expires sessions of h idle for
+// longer than ttl, checking every interval.
+func NewJanitor(h *Handler, ttl, interval time.Duration) *Janitor {
+	return &Janitor{
+		handler:  h,
+		ttl:      ttl,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start runs the janitor loop until Stop is called. It is meant to be
+// run in its own goroutine.
+func (j *Janitor) Start() {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			j.sweep()
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+// Stop terminates the janitor loop started by Start.
+func (j *Janitor) Stop() {
+	close(j.stop)
+}
+
+func (j *Janitor) sweep() {
+	h := j.handler
+	if h.sessionStore == nil {
+		return
+	}
+	cutoff := time.Now().Add(-j.ttl)
+	ids, err := h.sessionStore.IdleSince(cutoff)
+	if err != nil {
+		h.logger.Error("janitor: error listing idle sessions", "error", err)
+		return
+	}
+	for _, id := range ids {
+		j.expire(id)
+	}
+}
+
+// expire removes a single idle session's storage and session record,
+// holding the same per-session gate Fragment does so expiry can't race
+// a Fragment request still mid-write for this session.
+func (j *Janitor) expire(id string) {
+	h := j.handler
+	h.logger.Info("janitor: expiring idle session", "session", id)
+
+	gateEntry, err := h.sessionGate.lock(id)
+	if err != nil {
+		h.logger.Warn("janitor: error acquiring session gate", "session", id, "error", err)
+		return
+	}
+	defer h.sessionGate.unlock(id, gateEntry)
+
+	sess, ok, err := h.sessionStore.Get(id)
+	if rmErr := h.storage.Remove(id); rmErr != nil {
+		h.logger.Error("janitor: error removing storage for session", "session", id, "error", rmErr)
+		return
+	}
+	if err := h.sessionStore.Delete(id); err != nil {
+		h.logger.Error("janitor: error deleting session record", "session", id, "error", err)
+		return
+	}
+	h.adjustActiveSessions(-1)
+	var dir string
+	if err == nil && ok {
+		h.metrics.SessionClosed(time.Since(sess.CreatedAt))
+		dir = sess.Dir
+	}
+	h.fireEvent(EventCancelSession, id, dir, nil)
+}
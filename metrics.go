@@ -0,0 +1,105 @@
+package gobits
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Fragment outcome labels reported via Metrics.FragmentReceived.
+const (
+	OutcomeOK          = "ok"
+	OutcomeRangeError  = "range_error"
+	OutcomeBlacklisted = "blacklisted"
+	OutcomeTooLarge    = "too_large"
+)
+
+// Metrics is a pluggable hook for recording Handler throughput and
+// per-session health. Install one with Handler.SetMetrics; Handler
+// discards everything until then. Use NewPrometheusMetrics for an
+// implementation backed by Prometheus collectors.
+type Metrics interface {
+	// ActiveSessions reports the current number of open sessions.
+	ActiveSessions(n int)
+	// FragmentReceived records one Fragment request's outcome and how
+	// many bytes of its body were written to storage.
+	FragmentReceived(outcome string, bytes uint64)
+	// FragmentWriteDuration records how long a Fragment request spent
+	// writing its body to storage.
+	FragmentWriteDuration(d time.Duration)
+	// SessionClosed records how long a session was open for, on
+	// Close-Session, Cancel-Session, or janitor expiry.
+	SessionClosed(age time.Duration)
+}
+
+// noopMetrics discards everything; it's the default Metrics so call
+// sites never have to nil-check b.metrics.
+type noopMetrics struct{}
+
+func (noopMetrics) ActiveSessions(int)                  {}
+func (noopMetrics) FragmentReceived(string, uint64)     {}
+func (noopMetrics) FragmentWriteDuration(time.Duration) {}
+func (noopMetrics) SessionClosed(time.Duration)         {}
+
+// PrometheusMetrics is a Metrics implementation backed by Prometheus
+// collectors. Create one with NewPrometheusMetrics.
+type PrometheusMetrics struct {
+	activeSessions prometheus.Gauge
+	fragmentsTotal *prometheus.CounterVec
+	fragmentBytes  *prometheus.CounterVec
+	writeDuration  prometheus.Histogram
+	sessionAge     prometheus.Histogram
+}
+
+// NewPrometheusMetrics creates a PrometheusMetrics and registers its
+// collectors against reg, so operators can wire Handler into an
+// existing /metrics endpoint.
+func NewPrometheusMetrics(reg prometheus.Registerer) *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		activeSessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gobits_active_sessions",
+			Help: "Number of BITS upload sessions currently open.",
+		}),
+		fragmentsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gobits_fragments_received_total",
+			Help: "Fragment requests handled, by outcome.",
+		}, []string{"outcome"}),
+		fragmentBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gobits_fragment_bytes_total",
+			Help: "Bytes written by Fragment requests, by outcome.",
+		}, []string{"outcome"}),
+		writeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gobits_fragment_write_duration_seconds",
+			Help:    "Time spent writing a Fragment request's body to storage.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		sessionAge: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gobits_session_age_seconds",
+			Help:    "Age of a session when it is closed, cancelled, or expired by the janitor.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		}),
+	}
+	reg.MustRegister(m.activeSessions, m.fragmentsTotal, m.fragmentBytes, m.writeDuration, m.sessionAge)
+	return m
+}
+
+// ActiveSessions implements Metrics.
+func (m *PrometheusMetrics) ActiveSessions(n int) {
+	m.activeSessions.Set(float64(n))
+}
+
+// FragmentReceived implements Metrics.
+func (m *PrometheusMetrics) FragmentReceived(outcome string, bytes uint64) {
+	m.fragmentsTotal.WithLabelValues(outcome).Inc()
+	m.fragmentBytes.WithLabelValues(outcome).Add(float64(bytes))
+}
+
+// FragmentWriteDuration implements Metrics.
+func (m *PrometheusMetrics) FragmentWriteDuration(d time.Duration) {
+	m.writeDuration.Observe(d.Seconds())
+}
+
+// SessionClosed implements Metrics.
+func (m *PrometheusMetrics) SessionClosed(age time.Duration) {
+	m.sessionAge.Observe(age.Seconds())
+}
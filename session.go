@@ -0,0 +1,141 @@
+package gobits
+
+import (
+	"sort"
+	"time"
+)
+
+// Interval is an inclusive range of byte offsets, [Start, End], that has
+// been received for a file.
+type Interval struct {
+	Start uint64
+	End   uint64
+}
+
+// FileState tracks what has been received so far for one file within a
+// session.
+type FileState struct {
+	// Length is the declared total length of the file, once known from
+	// a Content-Range header; zero until then.
+	Length uint64
+	// Received holds the sorted, non-overlapping, non-adjacent
+	// intervals of bytes written so far.
+	Received []Interval
+	// HashState holds the MarshalBinary output of any in-progress
+	// content digests for this file, keyed by algorithm name ("md5",
+	// "sha256"), so a resumed upload can continue hashing instead of
+	// starting over.
+	HashState map[string][]byte
+}
+
+// Size returns how many contiguous bytes starting at offset 0 have been
+// received, i.e. what a client should be told via
+// BITS-Received-Content-Range.
+func (f *FileState) Size() uint64 {
+	if len(f.Received) == 0 {
+		return 0
+	}
+	if f.Received[0].Start != 0 {
+		return 0
+	}
+	return f.Received[0].End + 1
+}
+
+// addInterval merges [start, end] into f.Received, combining it with any
+// overlapping or adjacent intervals.
+func (f *FileState) addInterval(start, end uint64) {
+	merged := Interval{Start: start, End: end}
+	var out []Interval
+	inserted := false
+	for _, iv := range f.Received {
+		switch {
+		case iv.End+1 < merged.Start:
+			// iv is entirely before merged and not adjacent
+			out = append(out, iv)
+		case merged.End+1 < iv.Start:
+			// iv is entirely after merged and not adjacent
+			if !inserted {
+				out = append(out, merged)
+				inserted = true
+			}
+			out = append(out, iv)
+		default:
+			// overlapping or adjacent: fold into merged
+			if iv.Start < merged.Start {
+				merged.Start = iv.Start
+			}
+			if iv.End > merged.End {
+				merged.End = iv.End
+			}
+		}
+	}
+	if !inserted {
+		out = append(out, merged)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start < out[j].Start })
+	f.Received = out
+}
+
+// Session is the persisted state for one BITS upload session.
+type Session struct {
+	ID             string
+	Protocol       string
+	Principal      string
+	CreatedAt      time.Time
+	LastActivity   time.Time
+	DeclaredLength uint64
+	Dir            string
+	Files          map[string]*FileState
+	// ReplyURL is the client-supplied BITS-Reply-URL from Create-Session,
+	// recorded when Protocol is the upload-reply variant.
+	ReplyURL string
+	// Reply holds the server's application-defined reply body, set once
+	// the EventRecieveFile callback returns one, to be sent back to the
+	// client in the Close-Session response per the BITS upload-reply
+	// protocol.
+	Reply []byte
+}
+
+// clone returns a deep copy of f, so a caller holding it can't observe
+// or race with later mutations of the original.
+func (f *FileState) clone() *FileState {
+	out := &FileState{Length: f.Length}
+	if f.Received != nil {
+		out.Received = append([]Interval(nil), f.Received...)
+	}
+	if f.HashState != nil {
+		out.HashState = make(map[string][]byte, len(f.HashState))
+		for k, v := range f.HashState {
+			out.HashState[k] = append([]byte(nil), v...)
+		}
+	}
+	return out
+}
+
+// clone returns a deep copy of s, so a caller holding it can't observe
+// or race with later mutations of the original, e.g. a concurrent
+// UpdateFragment appending to the same Files entry.
+func (s *Session) clone() *Session {
+	out := *s
+	out.Files = make(map[string]*FileState, len(s.Files))
+	for name, f := range s.Files {
+		out.Files[name] = f.clone()
+	}
+	if s.Reply != nil {
+		out.Reply = append([]byte(nil), s.Reply...)
+	}
+	return &out
+}
+
+// newSession returns a Session ready to be handed to a SessionStore.
+func newSession(id, protocol, dir string) *Session {
+	now := time.Now()
+	return &Session{
+		ID:           id,
+		Protocol:     protocol,
+		CreatedAt:    now,
+		LastActivity: now,
+		Dir:          dir,
+		Files:        make(map[string]*FileState),
+	}
+}
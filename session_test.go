@@ -0,0 +1,95 @@
+package gobits
+
+import "testing"
+
+func TestFileStateAddInterval(t *testing.T) {
+	tests := []struct {
+		name   string
+		starts []Interval
+		add    Interval
+		want   []Interval
+	}{
+		{
+			name: "first interval",
+			add:  Interval{Start: 0, End: 9},
+			want: []Interval{{Start: 0, End: 9}},
+		},
+		{
+			name:   "disjoint, stays separate",
+			starts: []Interval{{Start: 0, End: 9}},
+			add:    Interval{Start: 20, End: 29},
+			want:   []Interval{{Start: 0, End: 9}, {Start: 20, End: 29}},
+		},
+		{
+			name:   "adjacent merges",
+			starts: []Interval{{Start: 0, End: 9}},
+			add:    Interval{Start: 10, End: 19},
+			want:   []Interval{{Start: 0, End: 19}},
+		},
+		{
+			name:   "overlapping merges",
+			starts: []Interval{{Start: 0, End: 9}},
+			add:    Interval{Start: 5, End: 19},
+			want:   []Interval{{Start: 0, End: 19}},
+		},
+		{
+			name:   "fills gap bridging two intervals",
+			starts: []Interval{{Start: 0, End: 9}, {Start: 20, End: 29}},
+			add:    Interval{Start: 10, End: 19},
+			want:   []Interval{{Start: 0, End: 29}},
+		},
+		{
+			name:   "out of order insertion stays sorted",
+			starts: []Interval{{Start: 20, End: 29}},
+			add:    Interval{Start: 0, End: 9},
+			want:   []Interval{{Start: 0, End: 9}, {Start: 20, End: 29}},
+		},
+		{
+			name:   "fully contained is a no-op",
+			starts: []Interval{{Start: 0, End: 29}},
+			add:    Interval{Start: 10, End: 19},
+			want:   []Interval{{Start: 0, End: 29}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FileState{Received: append([]Interval(nil), tt.starts...)}
+			f.addInterval(tt.add.Start, tt.add.End)
+			if len(f.Received) != len(tt.want) {
+				t.Fatalf("addInterval() = %v, want %v", f.Received, tt.want)
+			}
+			for i, iv := range f.Received {
+				if iv != tt.want[i] {
+					t.Fatalf("addInterval() = %v, want %v", f.Received, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFileStateSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		received []Interval
+		want     uint64
+	}{
+		{name: "empty", received: nil, want: 0},
+		{name: "gap at start", received: []Interval{{Start: 1, End: 9}}, want: 0},
+		{name: "contiguous from zero", received: []Interval{{Start: 0, End: 9}}, want: 10},
+		{
+			name:     "only counts the leading contiguous run",
+			received: []Interval{{Start: 0, End: 9}, {Start: 20, End: 29}},
+			want:     10,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FileState{Received: tt.received}
+			if got := f.Size(); got != tt.want {
+				t.Errorf("Size() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
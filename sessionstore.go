@@ -0,0 +1,169 @@
+package gobits
+
+import (
+	"sync"
+	"time"
+)
+
+// SessionStore persists Session state so that in-progress uploads
+// survive a server restart, and so a resumed upload can be answered
+// with an accurate BITS-Received-Content-Range instead of just the
+// on-disk file size.
+type SessionStore interface {
+	// Create records a newly created session.
+	Create(s *Session) error
+	// Get returns the session for id, or ok == false if it doesn't
+	// exist.
+	Get(id string) (s *Session, ok bool, err error)
+	// UpdateFragment records that [start, end] has been received for
+	// filename within session id, updates LastActivity, and, if
+	// declaredLength is non-zero, records it as the file's declared
+	// length. It must serialize concurrent updates for the same
+	// session.
+	UpdateFragment(id, filename string, start, end, declaredLength uint64) error
+	// UpdateHashState persists the partial content-digest state for
+	// filename within session id, keyed by algorithm name, so a resumed
+	// upload can continue hashing instead of starting over.
+	UpdateHashState(id, filename string, state map[string][]byte) error
+	// SetReply records the server's application-defined reply body for
+	// session id, to be delivered to the client on Close-Session per the
+	// BITS upload-reply protocol.
+	SetReply(id string, reply []byte) error
+	// Delete removes a session's state.
+	Delete(id string) error
+	// IdleSince returns the ids of all sessions whose LastActivity is
+	// before cutoff, for use by a janitor.
+	IdleSince(cutoff time.Time) ([]string, error)
+}
+
+// MemorySessionStore is the default SessionStore: an in-process map
+// that does not survive a restart. Use BoltSessionStore for durable,
+// restart-safe session state.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	locks    map[string]*sync.Mutex
+}
+
+// NewMemorySessionStore returns an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]*Session),
+		locks:    make(map[string]*sync.Mutex),
+	}
+}
+
+func (m *MemorySessionStore) sessionLock(id string) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		m.locks[id] = l
+	}
+	return l
+}
+
+// Create implements SessionStore.
+func (m *MemorySessionStore) Create(s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.ID] = s
+	return nil
+}
+
+// Get implements SessionStore. It returns a deep copy, the way
+// BoltSessionStore effectively does via its JSON round-trip, so the
+// caller can't race with a later UpdateFragment/UpdateHashState/SetReply
+// mutating the live session.
+func (m *MemorySessionStore) Get(id string) (*Session, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, false, nil
+	}
+	return s.clone(), true, nil
+}
+
+// UpdateFragment implements SessionStore.
+func (m *MemorySessionStore) UpdateFragment(id, filename string, start, end, declaredLength uint64) error {
+	lock := m.sessionLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	m.mu.Unlock()
+	if !ok {
+		return errSessionNotFound
+	}
+
+	f, ok := s.Files[filename]
+	if !ok {
+		f = &FileState{}
+		s.Files[filename] = f
+	}
+	if declaredLength != 0 {
+		f.Length = declaredLength
+	}
+	f.addInterval(start, end)
+	s.LastActivity = time.Now()
+	return nil
+}
+
+// UpdateHashState implements SessionStore.
+func (m *MemorySessionStore) UpdateHashState(id, filename string, state map[string][]byte) error {
+	lock := m.sessionLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	m.mu.Unlock()
+	if !ok {
+		return errSessionNotFound
+	}
+
+	f, ok := s.Files[filename]
+	if !ok {
+		f = &FileState{}
+		s.Files[filename] = f
+	}
+	f.HashState = state
+	return nil
+}
+
+// SetReply implements SessionStore.
+func (m *MemorySessionStore) SetReply(id string, reply []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return errSessionNotFound
+	}
+	s.Reply = reply
+	return nil
+}
+
+// Delete implements SessionStore.
+func (m *MemorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	delete(m.locks, id)
+	return nil
+}
+
+// IdleSince implements SessionStore.
+func (m *MemorySessionStore) IdleSince(cutoff time.Time) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []string
+	for id, s := range m.sessions {
+		if s.LastActivity.Before(cutoff) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
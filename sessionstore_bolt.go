@@ -0,0 +1,200 @@
+package gobits
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// sessionsBucket is the single bolt bucket sessions are stored in, one
+// JSON-encoded record per session UUID.
+var sessionsBucket = []byte("sessions")
+
+// BoltSessionStore is a SessionStore backed by a bolt/bbolt database
+// file, so in-progress uploads survive a server restart.
+type BoltSessionStore struct {
+	db *bolt.DB
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// NewBoltSessionStore opens (creating if necessary) a bolt database at
+// path and returns a SessionStore backed by it.
+func NewBoltSessionStore(path string) (*BoltSessionStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltSessionStore{
+		db:    db,
+		locks: make(map[string]*sync.Mutex),
+	}, nil
+}
+
+// Close closes the underlying bolt database.
+func (b *BoltSessionStore) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltSessionStore) sessionLock(id string) *sync.Mutex {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l, ok := b.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		b.locks[id] = l
+	}
+	return l
+}
+
+func (b *BoltSessionStore) get(tx *bolt.Tx, id string) (*Session, bool, error) {
+	raw := tx.Bucket(sessionsBucket).Get([]byte(id))
+	if raw == nil {
+		return nil, false, nil
+	}
+	var s Session
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, false, err
+	}
+	return &s, true, nil
+}
+
+func (b *BoltSessionStore) put(tx *bolt.Tx, s *Session) error {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(sessionsBucket).Put([]byte(s.ID), raw)
+}
+
+// Create implements SessionStore.
+func (b *BoltSessionStore) Create(s *Session) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return b.put(tx, s)
+	})
+}
+
+// Get implements SessionStore.
+func (b *BoltSessionStore) Get(id string) (*Session, bool, error) {
+	var s *Session
+	var ok bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		s, ok, err = b.get(tx, id)
+		return err
+	})
+	return s, ok, err
+}
+
+// UpdateFragment implements SessionStore.
+func (b *BoltSessionStore) UpdateFragment(id, filename string, start, end, declaredLength uint64) error {
+	lock := b.sessionLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		s, ok, err := b.get(tx, id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errSessionNotFound
+		}
+		if s.Files == nil {
+			s.Files = make(map[string]*FileState)
+		}
+		f, ok := s.Files[filename]
+		if !ok {
+			f = &FileState{}
+			s.Files[filename] = f
+		}
+		if declaredLength != 0 {
+			f.Length = declaredLength
+		}
+		f.addInterval(start, end)
+		s.LastActivity = time.Now()
+		return b.put(tx, s)
+	})
+}
+
+// UpdateHashState implements SessionStore.
+func (b *BoltSessionStore) UpdateHashState(id, filename string, state map[string][]byte) error {
+	lock := b.sessionLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		s, ok, err := b.get(tx, id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errSessionNotFound
+		}
+		if s.Files == nil {
+			s.Files = make(map[string]*FileState)
+		}
+		f, ok := s.Files[filename]
+		if !ok {
+			f = &FileState{}
+			s.Files[filename] = f
+		}
+		f.HashState = state
+		return b.put(tx, s)
+	})
+}
+
+// SetReply implements SessionStore.
+func (b *BoltSessionStore) SetReply(id string, reply []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		s, ok, err := b.get(tx, id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errSessionNotFound
+		}
+		s.Reply = reply
+		return b.put(tx, s)
+	})
+}
+
+// Delete implements SessionStore.
+func (b *BoltSessionStore) Delete(id string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete([]byte(id))
+	})
+	b.mu.Lock()
+	delete(b.locks, id)
+	b.mu.Unlock()
+	return err
+}
+
+// IdleSince implements SessionStore.
+func (b *BoltSessionStore) IdleSince(cutoff time.Time) ([]string, error) {
+	var ids []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(k, v []byte) error {
+			var s Session
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			if s.LastActivity.Before(cutoff) {
+				ids = append(ids, s.ID)
+			}
+			return nil
+		})
+	})
+	return ids, err
+}
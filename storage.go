@@ -0,0 +1,122 @@
+package gobits
+
+import (
+	"io"
+	"os"
+	"path"
+)
+
+// SessionWriter represents the storage allocated for one BITS session.
+type SessionWriter interface {
+	// Path returns a backend-specific identifier for where the session
+	// is stored (a directory for LocalFS, a bucket/key prefix for a
+	// remote backend). It is only meant for logging/callbacks, not for
+	// direct filesystem access.
+	Path() string
+}
+
+// FragmentWriter receives the bytes of a single uploaded file at
+// whatever absolute offset the caller chooses, mirroring how BITS
+// fragments can be retransmitted or arrive with overlapping ranges.
+type FragmentWriter interface {
+	io.WriterAt
+	io.Closer
+}
+
+// Storage abstracts the persistence layer a Handler uses for
+// in-progress and finished uploads. LocalFS, the default, mirrors the
+// original on-disk behavior under cfg.TempDir. Other implementations
+// (S3Storage, SeaweedFSStorage, ...) let a Handler front remote object
+// storage directly, which is what operators running many Handlers
+// behind a load balancer want instead of a writable local disk per
+// node.
+type Storage interface {
+	// CreateSession allocates storage for a new session.
+	CreateSession(sessionID string) (SessionWriter, error)
+	// Exists reports whether sessionID has been created and not yet
+	// removed.
+	Exists(sessionID string) (bool, error)
+	// OpenFragment opens name within sessionID for writing, creating it
+	// if it doesn't exist yet.
+	OpenFragment(sessionID, name string) (FragmentWriter, error)
+	// Stat returns the current size in bytes of name within sessionID,
+	// or zero if it does not exist yet.
+	Stat(sessionID, name string) (uint64, error)
+	// Finalize marks name within sessionID as complete and returns the
+	// path or key clients/callbacks should use to refer to it.
+	Finalize(sessionID, name string) (string, error)
+	// Remove discards everything stored for sessionID.
+	Remove(sessionID string) error
+}
+
+// LocalFS is the default Storage backend. It stores each session under
+// its own subdirectory of Dir, exactly as the original handler did.
+type LocalFS struct {
+	// Dir is the base directory sessions are created under, equivalent
+	// to Config.TempDir.
+	Dir string
+}
+
+// NewLocalFS returns a LocalFS rooted at dir.
+func NewLocalFS(dir string) *LocalFS {
+	return &LocalFS{Dir: dir}
+}
+
+func (l *LocalFS) sessionDir(sessionID string) string {
+	return path.Join(l.Dir, sessionID)
+}
+
+type localSessionWriter struct {
+	dir string
+}
+
+func (s *localSessionWriter) Path() string {
+	return s.dir
+}
+
+// CreateSession implements Storage.
+func (l *LocalFS) CreateSession(sessionID string) (SessionWriter, error) {
+	dir := l.sessionDir(sessionID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localSessionWriter{dir: dir}, nil
+}
+
+// Exists implements Storage.
+func (l *LocalFS) Exists(sessionID string) (bool, error) {
+	return exists(l.sessionDir(sessionID))
+}
+
+// OpenFragment implements Storage.
+func (l *LocalFS) OpenFragment(sessionID, name string) (FragmentWriter, error) {
+	dir := l.sessionDir(sessionID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path.Join(dir, name), os.O_RDWR|os.O_CREATE, 0755)
+}
+
+// Stat implements Storage.
+func (l *LocalFS) Stat(sessionID, name string) (uint64, error) {
+	info, err := os.Stat(path.Join(l.sessionDir(sessionID), name))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint64(info.Size()), nil
+}
+
+// Finalize implements Storage. LocalFS has nothing to do beyond
+// reporting the final path, since fragments are already written in
+// place.
+func (l *LocalFS) Finalize(sessionID, name string) (string, error) {
+	return path.Join(l.sessionDir(sessionID), name), nil
+}
+
+// Remove implements Storage.
+func (l *LocalFS) Remove(sessionID string) error {
+	return os.RemoveAll(l.sessionDir(sessionID))
+}
@@ -0,0 +1,98 @@
+package gobits
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+)
+
+// SeaweedFSStorage is a Storage backend that stages fragments on local
+// disk exactly like LocalFS, then POSTs the finalized file to a
+// SeaweedFS filer on Finalize. This keeps fragment writes simple while
+// still landing the finished upload in SeaweedFS instead of on durable
+// local storage.
+type SeaweedFSStorage struct {
+	local *LocalFS
+	// FilerURL is the base URL of the SeaweedFS filer, e.g.
+	// "http://filer.internal:8888".
+	FilerURL string
+	// FilerPath is the directory under FilerURL the finalized file is
+	// stored at, keyed by session UUID.
+	FilerPath string
+	// Client is used to perform the filer POST; defaults to
+	// http.DefaultClient when nil.
+	Client *http.Client
+}
+
+// NewSeaweedFSStorage returns a SeaweedFSStorage staging fragments under
+// tempDir and finalizing uploads to filerURL/filerPath/<uuid>/<name>.
+func NewSeaweedFSStorage(tempDir, filerURL, filerPath string) *SeaweedFSStorage {
+	return &SeaweedFSStorage{
+		local:     NewLocalFS(tempDir),
+		FilerURL:  filerURL,
+		FilerPath: filerPath,
+		Client:    http.DefaultClient,
+	}
+}
+
+// CreateSession implements Storage.
+func (s *SeaweedFSStorage) CreateSession(sessionID string) (SessionWriter, error) {
+	return s.local.CreateSession(sessionID)
+}
+
+// Exists implements Storage.
+func (s *SeaweedFSStorage) Exists(sessionID string) (bool, error) {
+	return s.local.Exists(sessionID)
+}
+
+// OpenFragment implements Storage.
+func (s *SeaweedFSStorage) OpenFragment(sessionID, name string) (FragmentWriter, error) {
+	return s.local.OpenFragment(sessionID, name)
+}
+
+// Stat implements Storage.
+func (s *SeaweedFSStorage) Stat(sessionID, name string) (uint64, error) {
+	return s.local.Stat(sessionID, name)
+}
+
+// Finalize implements Storage. It POSTs the staged file to the
+// SeaweedFS filer, then removes the local copy.
+func (s *SeaweedFSStorage) Finalize(sessionID, name string) (string, error) {
+	localPath := path.Join(s.local.sessionDir(sessionID), name)
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", fmt.Errorf("seaweedfs: open staged file: %w", err)
+	}
+	defer f.Close()
+
+	dest := s.FilerURL + "/" + path.Join(s.FilerPath, sessionID, name)
+	req, err := http.NewRequest(http.MethodPost, dest, f)
+	if err != nil {
+		return "", fmt.Errorf("seaweedfs: build request: %w", err)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("seaweedfs: filer POST: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("seaweedfs: filer POST to %q returned %s", dest, resp.Status)
+	}
+
+	f.Close()
+	if err := os.Remove(localPath); err != nil {
+		return "", fmt.Errorf("seaweedfs: remove staged file: %w", err)
+	}
+	return dest, nil
+}
+
+// Remove implements Storage.
+func (s *SeaweedFSStorage) Remove(sessionID string) error {
+	return s.local.Remove(sessionID)
+}
@@ -0,0 +1,75 @@
+package gobits
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// uuidRegexp matches the canonical 8-4-4-4-12 hex representation of a
+// UUID, as used for BITS-Session-Id values.
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// newUUID generates a random version 4 UUID to use as a BITS session id.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// isValidUUID reports whether s looks like a canonical UUID.
+func isValidUUID(s string) bool {
+	return uuidRegexp.MatchString(s)
+}
+
+// exists reports whether path is present on disk.
+func exists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// parseRange parses a BITS "Content-Range" header of the form
+// "bytes start-end/total" and returns the three components.
+// https://msdn.microsoft.com/en-us/library/aa362841(v=vs.85).aspx
+func parseRange(header string) (start, end, total uint64, err error) {
+	header = strings.TrimSpace(header)
+	header = strings.TrimPrefix(header, "bytes")
+	header = strings.TrimSpace(header)
+
+	parts := strings.SplitN(header, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range header: %q", header)
+	}
+
+	rangeParts := strings.SplitN(parts[0], "-", 2)
+	if len(rangeParts) != 2 {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range header: %q", header)
+	}
+
+	start, err = strconv.ParseUint(rangeParts[0], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range start: %q", rangeParts[0])
+	}
+	end, err = strconv.ParseUint(rangeParts[1], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range end: %q", rangeParts[1])
+	}
+	total, err = strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range total: %q", parts[1])
+	}
+	return start, end, total, nil
+}